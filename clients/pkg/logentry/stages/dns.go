@@ -0,0 +1,280 @@
+package stages
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+const defaultDNSTarget = "addresses"
+
+var (
+	ErrEmptyDNSStageConfig  = errors.New("dns stage config cannot be empty")
+	ErrEmptySourceDNSConfig = errors.New("source cannot be empty")
+	ErrInvalidDNSType       = errors.New("type must be one of a, aaaa, cname, mx, txt, srv")
+)
+
+// forwardRecordTypes restricts the dns stage's `type` to forward-lookup record types.
+// Unlike reverse_dns, ptr is meaningless here: the stage resolves a hostname, not an ip.
+var forwardRecordTypes = map[string]uint16{
+	"a":     recordTypes["a"],
+	"aaaa":  recordTypes["aaaa"],
+	"cname": recordTypes["cname"],
+	"mx":    recordTypes["mx"],
+	"txt":   recordTypes["txt"],
+	"srv":   recordTypes["srv"],
+}
+
+// DNSConfig represents the dns stage config, the forward-lookup counterpart of
+// reverse_dns: it resolves a hostname extracted upstream into addresses or other records.
+type DNSConfig struct {
+	Source      *string         `mapstructure:"source"`
+	Type        string          `mapstructure:"type"`
+	Target      *string         `mapstructure:"target"`
+	Separator   string          `mapstructure:"separator"`
+	Resolver    *ResolverConfig `mapstructure:"resolver"`
+	CacheSize   int             `mapstructure:"cache_size"`
+	SuccessTTL  time.Duration   `mapstructure:"success_ttl"`
+	FailureTTL  time.Duration   `mapstructure:"failure_ttl"`
+	MaxInflight int             `mapstructure:"max_inflight"`
+}
+
+func validateDNSConfig(c *DNSConfig) (string, string, error) {
+	if c.Source != nil && *c.Source == "" {
+		return "", "", ErrEmptySourceDNSConfig
+	}
+
+	qtype := c.Type
+	if qtype == "" {
+		qtype = "a"
+	}
+	if _, ok := forwardRecordTypes[qtype]; !ok {
+		return "", "", ErrInvalidDNSType
+	}
+
+	target := defaultDNSTarget
+	if c.Target != nil && *c.Target != "" {
+		target = *c.Target
+	}
+
+	if c.Separator == "" {
+		c.Separator = ";"
+	}
+
+	return qtype, target, validateResolverConfig(c.Resolver)
+}
+
+func newDNSStage(logger log.Logger, configs interface{}, registerer prometheus.Registerer) (Stage, error) {
+	cfgs := &DNSConfig{}
+	if err := decodeConfig(configs, cfgs); err != nil {
+		return nil, err
+	}
+
+	qtype, target, err := validateDNSConfig(cfgs)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := newResolver(cfgs.Resolver)
+	if err != nil {
+		return nil, err
+	}
+
+	cache, err := newRDNSCache(cfgs.CacheSize, cfgs.SuccessTTL, cfgs.FailureTTL, cfgs.MaxInflight, newRDNSCacheMetrics(registerer))
+	if err != nil {
+		return nil, err
+	}
+
+	return &dnsStage{
+		logger:   logger,
+		cfgs:     cfgs,
+		qtype:    recordTypes[qtype],
+		target:   target,
+		resolver: res,
+		cache:    cache,
+	}, nil
+}
+
+type dnsStage struct {
+	logger   log.Logger
+	cfgs     *DNSConfig
+	qtype    uint16
+	target   string
+	resolver *resolver
+	cache    *rdnsCache
+}
+
+// Run implements Stage
+func (s *dnsStage) Run(in chan Entry) chan Entry {
+	out := make(chan Entry)
+	go func() {
+		defer close(out)
+		for e := range in {
+			s.process(e.Labels, e.Extracted)
+			out <- e
+		}
+	}()
+	return out
+}
+
+// Name implements Stage
+func (s *dnsStage) Name() string {
+	return StageTypeDNS
+}
+
+func (s *dnsStage) process(labels model.LabelSet, extracted map[string]interface{}) {
+	if s.cfgs.Source == nil {
+		return
+	}
+
+	if _, ok := extracted[*s.cfgs.Source]; !ok {
+		if Debug {
+			level.Debug(s.logger).Log("msg", "source does not exist in the set of extracted values", "source", *s.cfgs.Source)
+		}
+		return
+	}
+
+	name, err := getString(extracted[*s.cfgs.Source])
+	if err != nil {
+		if Debug {
+			level.Debug(s.logger).Log("msg", "failed to convert source value to string", "source", *s.cfgs.Source, "err", err, "type", reflect.TypeOf(extracted[*s.cfgs.Source]))
+		}
+		return
+	}
+	if name == "" {
+		level.Debug(s.logger).Log("msg", "source was empty")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.lookupTimeout())
+	defer cancel()
+
+	fields, err := s.lookup(ctx, name)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrDNSNameError):
+			level.Debug(s.logger).Log("msg", "dns lookup returned NXDOMAIN", "source", name)
+		case errors.Is(err, ErrDNSServerFailure):
+			level.Warn(s.logger).Log("msg", "dns lookup failed: resolver error", "source", name, "err", err)
+		default:
+			level.Debug(s.logger).Log("msg", "dns lookup failed", "source", name, "err", err)
+		}
+		return
+	}
+
+	values, ok := fields[s.resultKey()]
+	if !ok || len(values) == 0 {
+		return
+	}
+
+	joined := strings.Join(values, s.cfgs.Separator)
+	extracted[s.target] = joined
+	if model.LabelName(s.target).IsValid() {
+		labels[model.LabelName(s.target)] = model.LabelValue(joined)
+	}
+}
+
+// resultKey returns the extractAnswers key that holds the field relevant to s.qtype.
+func (s *dnsStage) resultKey() string {
+	switch s.qtype {
+	case recordTypes["mx"]:
+		return "mx_hosts"
+	case recordTypes["txt"]:
+		return "txt_records"
+	case recordTypes["cname"]:
+		return "cnames"
+	case recordTypes["srv"]:
+		return "srv_targets"
+	default:
+		return "addresses"
+	}
+}
+
+// lookup resolves name using the configured resolver, or falls back to the system
+// resolver when no resolver block is configured, caching results like reverse_dns does,
+// and honors ctx's cancellation/deadline either way.
+func (s *dnsStage) lookup(ctx context.Context, name string) (map[string][]string, error) {
+	key := rdnsCacheKey{qtype: s.qtype, name: name}
+	return s.cache.lookup(key, func() (map[string][]string, error) {
+		if s.resolver == nil {
+			return s.systemLookup(ctx, name)
+		}
+
+		msg, err := s.resolver.lookup(ctx, name, s.qtype)
+		if err != nil {
+			return nil, err
+		}
+		return extractAnswers(msg, s.qtype), nil
+	})
+}
+
+// lookupTimeout returns the per-entry deadline to apply to a lookup so that an
+// unreachable or slow resolver cannot stall the pipeline beyond the configured budget.
+func (s *dnsStage) lookupTimeout() time.Duration {
+	if s.resolver == nil {
+		return defaultResolverTimeout
+	}
+	return s.resolver.budget()
+}
+
+// systemLookup services a subset of record types via the os-level resolver, preserving
+// reverse_dns's convention of working out of the box when no resolver block is configured.
+func (s *dnsStage) systemLookup(ctx context.Context, name string) (map[string][]string, error) {
+	switch s.qtype {
+	case recordTypes["a"]:
+		addrs, err := net.DefaultResolver.LookupIP(ctx, "ip4", name)
+		if err != nil {
+			return nil, err
+		}
+		return map[string][]string{"addresses": ipStrings(addrs)}, nil
+	case recordTypes["aaaa"]:
+		addrs, err := net.DefaultResolver.LookupIP(ctx, "ip6", name)
+		if err != nil {
+			return nil, err
+		}
+		return map[string][]string{"addresses": ipStrings(addrs)}, nil
+	case recordTypes["cname"]:
+		cname, err := net.DefaultResolver.LookupCNAME(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		return map[string][]string{"cnames": {normaliseHost(cname)}}, nil
+	case recordTypes["txt"]:
+		txts, err := net.DefaultResolver.LookupTXT(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		return map[string][]string{"txt_records": txts}, nil
+	case recordTypes["mx"]:
+		mxs, err := net.DefaultResolver.LookupMX(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		hosts := make([]string, 0, len(mxs))
+		for _, mx := range mxs {
+			hosts = append(hosts, normaliseHost(mx.Host))
+		}
+		return map[string][]string{"mx_hosts": hosts}, nil
+	default:
+		return nil, errUnsupportedSystemLookup
+	}
+}
+
+// ipStrings renders a slice of net.IP as their string forms.
+func ipStrings(ips []net.IP) []string {
+	out := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		out = append(out, ip.String())
+	}
+	return out
+}
+
+var errUnsupportedSystemLookup = errors.New("record type requires a configured resolver block")
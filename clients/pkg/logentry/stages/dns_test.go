@@ -0,0 +1,190 @@
+package stages
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_DNS_process(t *testing.T) {
+	addr := startTestDNSServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		q := r.Question[0]
+		switch q.Qtype {
+		case dns.TypeA:
+			if q.Name == "example.com." {
+				rr, err := dns.NewRR(q.Name + " 60 IN A 93.184.216.34")
+				require.NoError(t, err)
+				m.Answer = append(m.Answer, rr)
+			} else {
+				m.Rcode = dns.RcodeNameError
+			}
+		case dns.TypeMX:
+			rr1, err := dns.NewRR(q.Name + " 60 IN MX 10 mail1.example.com.")
+			require.NoError(t, err)
+			rr2, err := dns.NewRR(q.Name + " 60 IN MX 20 mail2.example.com.")
+			require.NoError(t, err)
+			m.Answer = append(m.Answer, rr1, rr2)
+		default:
+			m.Rcode = dns.RcodeNameError
+		}
+		_ = w.WriteMsg(m)
+	})
+
+	field := "hostname"
+
+	newTestStage := func(t *testing.T, cfgs *DNSConfig) *dnsStage {
+		t.Helper()
+		qtype, target, err := validateDNSConfig(cfgs)
+		require.NoError(t, err)
+		res, err := newResolver(cfgs.Resolver)
+		require.NoError(t, err)
+		return &dnsStage{
+			logger:   logger,
+			cfgs:     cfgs,
+			qtype:    recordTypes[qtype],
+			target:   target,
+			resolver: res,
+			cache:    newTestRDNSCache(t),
+		}
+	}
+
+	t.Run("resolves an A record", func(t *testing.T) {
+		s := newTestStage(t, &DNSConfig{
+			Source:   &field,
+			Resolver: &ResolverConfig{Servers: []string{addr}},
+		})
+
+		labels := model.LabelSet{}
+		extracted := map[string]interface{}{"hostname": "example.com"}
+		s.process(labels, extracted)
+
+		require.Equal(t, "93.184.216.34", extracted["addresses"])
+		require.Equal(t, model.LabelValue("93.184.216.34"), labels["addresses"])
+	})
+
+	t.Run("multi-record mx lookup joined by separator", func(t *testing.T) {
+		target := "mx"
+		s := newTestStage(t, &DNSConfig{
+			Source:    &field,
+			Type:      "mx",
+			Target:    &target,
+			Separator: ",",
+			Resolver:  &ResolverConfig{Servers: []string{addr}},
+		})
+
+		labels := model.LabelSet{}
+		extracted := map[string]interface{}{"hostname": "example.com"}
+		s.process(labels, extracted)
+
+		require.Equal(t, "10:mail1.example.com,20:mail2.example.com", extracted["mx"])
+	})
+
+	t.Run("unresolvable name leaves extracted untouched", func(t *testing.T) {
+		s := newTestStage(t, &DNSConfig{
+			Source:   &field,
+			Resolver: &ResolverConfig{Servers: []string{addr}},
+		})
+
+		labels := model.LabelSet{}
+		extracted := map[string]interface{}{"hostname": "does-not-exist.invalid"}
+		s.process(labels, extracted)
+
+		require.Equal(t, model.LabelSet{}, labels)
+		require.NotContains(t, extracted, "addresses")
+	})
+
+	t.Run("empty source is a no-op", func(t *testing.T) {
+		s := newTestStage(t, &DNSConfig{
+			Source:   &field,
+			Resolver: &ResolverConfig{Servers: []string{addr}},
+		})
+
+		labels := model.LabelSet{}
+		extracted := map[string]interface{}{"hostname": ""}
+		s.process(labels, extracted)
+
+		require.Equal(t, model.LabelSet{}, labels)
+	})
+}
+
+func Test_DNS_systemLookup_filtersByAddressFamily(t *testing.T) {
+	s := &dnsStage{logger: logger, qtype: recordTypes["a"]}
+	fields, err := s.systemLookup(context.Background(), "localhost")
+	require.NoError(t, err)
+	for _, addr := range fields["addresses"] {
+		ip := net.ParseIP(addr)
+		require.NotNil(t, ip)
+		require.NotNil(t, ip.To4(), "type: a must not return an ipv6 address, got %s", addr)
+	}
+
+	// A host without any AAAA record must come back empty (or erroring), never with its
+	// ipv4 address substituted in: systemLookup asks net.Resolver.LookupIP for the "ip6"
+	// network, which filters by address family (net.LookupHost would not).
+	s = &dnsStage{logger: logger, qtype: recordTypes["aaaa"]}
+	fields, err = s.systemLookup(context.Background(), "localhost")
+	if err == nil {
+		for _, addr := range fields["addresses"] {
+			ip := net.ParseIP(addr)
+			require.NotNil(t, ip)
+			require.Nil(t, ip.To4(), "type: aaaa must not return an ipv4 address, got %s", addr)
+		}
+	}
+}
+
+func Test_newDNSStage_decodesDurationsFromYAMLStrings(t *testing.T) {
+	raw := map[string]interface{}{
+		"resolver": map[string]interface{}{
+			"servers": []interface{}{"127.0.0.1:53"},
+			"timeout": "2s",
+		},
+		"success_ttl": "10m",
+		"failure_ttl": "15s",
+	}
+
+	stage, err := newDNSStage(logger, raw, nil)
+	require.NoError(t, err)
+
+	s := stage.(*dnsStage)
+	require.Equal(t, 2*time.Second, s.resolver.client.Timeout)
+	require.Equal(t, 10*time.Minute, s.cache.successTTL)
+	require.Equal(t, 15*time.Second, s.cache.failureTTL)
+}
+
+func Test_validateDNSConfig(t *testing.T) {
+	t.Run("empty source is an error", func(t *testing.T) {
+		empty := ""
+		_, _, err := validateDNSConfig(&DNSConfig{Source: &empty})
+		require.ErrorIs(t, err, ErrEmptySourceDNSConfig)
+	})
+
+	t.Run("invalid type is an error", func(t *testing.T) {
+		_, _, err := validateDNSConfig(&DNSConfig{Type: "bogus"})
+		require.ErrorIs(t, err, ErrInvalidDNSType)
+	})
+
+	t.Run("ptr is rejected: it's a reverse_dns record type, not a forward one", func(t *testing.T) {
+		_, _, err := validateDNSConfig(&DNSConfig{Type: "ptr"})
+		require.ErrorIs(t, err, ErrInvalidDNSType)
+	})
+
+	t.Run("defaults type to a and target to addresses", func(t *testing.T) {
+		qtype, target, err := validateDNSConfig(&DNSConfig{})
+		require.NoError(t, err)
+		require.Equal(t, "a", qtype)
+		require.Equal(t, defaultDNSTarget, target)
+	})
+
+	t.Run("honours custom target", func(t *testing.T) {
+		custom := "resolved_ips"
+		_, target, err := validateDNSConfig(&DNSConfig{Target: &custom})
+		require.NoError(t, err)
+		require.Equal(t, custom, target)
+	})
+}
@@ -0,0 +1,171 @@
+package stages
+
+import (
+	"fmt"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	defaultRDNSCacheSize   = 1024
+	defaultRDNSSuccessTTL  = 5 * time.Minute
+	defaultRDNSFailureTTL  = 30 * time.Second
+	defaultRDNSMaxInflight = 64
+)
+
+// rdnsCacheKey identifies a single cached lookup.
+type rdnsCacheKey struct {
+	qtype uint16
+	name  string
+}
+
+func (k rdnsCacheKey) String() string {
+	return fmt.Sprintf("%d:%s", k.qtype, k.name)
+}
+
+// rdnsCacheEntry holds the result of a previous lookup, positive or negative.
+type rdnsCacheEntry struct {
+	fields    map[string][]string
+	err       error
+	expiresAt time.Time
+}
+
+func (e *rdnsCacheEntry) expired(now time.Time) bool {
+	return now.After(e.expiresAt)
+}
+
+// rdnsCacheMetrics are the Prometheus series exposed by an rdnsCache.
+type rdnsCacheMetrics struct {
+	hits           prometheus.Counter
+	misses         prometheus.Counter
+	inflight       prometheus.Gauge
+	lookupDuration prometheus.Histogram
+}
+
+func newRDNSCacheMetrics(registerer prometheus.Registerer) *rdnsCacheMetrics {
+	m := &rdnsCacheMetrics{
+		hits: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "loki_rdns_cache_hits_total",
+			Help: "Total count of dns/reverse_dns stage lookups served from cache.",
+		}),
+		misses: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "loki_rdns_cache_misses_total",
+			Help: "Total count of dns/reverse_dns stage lookups that missed the cache.",
+		}),
+		inflight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "loki_rdns_cache_inflight",
+			Help: "Number of dns/reverse_dns stage lookups currently in flight against the resolver.",
+		}),
+		lookupDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "loki_rdns_lookup_duration_seconds",
+			Help:    "Duration of dns/reverse_dns stage resolver lookups that missed the cache.",
+			Buckets: prometheus.DefBuckets,
+		}),
+	}
+	if registerer != nil {
+		m.hits = mustRegisterOrGet(registerer, m.hits).(prometheus.Counter)
+		m.misses = mustRegisterOrGet(registerer, m.misses).(prometheus.Counter)
+		m.inflight = mustRegisterOrGet(registerer, m.inflight).(prometheus.Gauge)
+		m.lookupDuration = mustRegisterOrGet(registerer, m.lookupDuration).(prometheus.Histogram)
+	}
+	return m
+}
+
+// mustRegisterOrGet registers c with registerer, returning the already-registered
+// collector of the same name if one exists rather than panicking or silently dropping it.
+func mustRegisterOrGet(registerer prometheus.Registerer, c prometheus.Collector) prometheus.Collector {
+	if err := registerer.Register(c); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector
+		}
+		panic(err)
+	}
+	return c
+}
+
+// rdnsCache is a size-bounded LRU cache of DNS lookup results, shared by the reverse_dns
+// and dns stages. Concurrent lookups for the same key are coalesced with singleflight so
+// that a burst of entries referencing the same name only issues one resolver query.
+type rdnsCache struct {
+	cache      *lru.Cache[rdnsCacheKey, *rdnsCacheEntry]
+	group      singleflight.Group
+	inflightCh chan struct{}
+	successTTL time.Duration
+	failureTTL time.Duration
+	metrics    *rdnsCacheMetrics
+}
+
+func newRDNSCache(size int, successTTL, failureTTL time.Duration, maxInflight int, metrics *rdnsCacheMetrics) (*rdnsCache, error) {
+	if size <= 0 {
+		size = defaultRDNSCacheSize
+	}
+	if successTTL <= 0 {
+		successTTL = defaultRDNSSuccessTTL
+	}
+	if failureTTL <= 0 {
+		failureTTL = defaultRDNSFailureTTL
+	}
+	if maxInflight <= 0 {
+		maxInflight = defaultRDNSMaxInflight
+	}
+
+	c, err := lru.New[rdnsCacheKey, *rdnsCacheEntry](size)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rdnsCache{
+		cache:      c,
+		inflightCh: make(chan struct{}, maxInflight),
+		successTTL: successTTL,
+		failureTTL: failureTTL,
+		metrics:    metrics,
+	}, nil
+}
+
+// lookup returns the cached result for key if still fresh, otherwise calls fn to resolve
+// it, coalescing concurrent calls for the same key into a single invocation of fn.
+func (c *rdnsCache) lookup(key rdnsCacheKey, fn func() (map[string][]string, error)) (map[string][]string, error) {
+	if entry, ok := c.cache.Get(key); ok && !entry.expired(time.Now()) {
+		c.metrics.hits.Inc()
+		return entry.fields, entry.err
+	}
+	c.metrics.misses.Inc()
+
+	// group.Do only ever invokes this function for the caller that actually owns the
+	// lookup (the "leader"); concurrent callers for the same key ("followers") block on
+	// Do and share its result without running the function at all. So gating inflightCh
+	// and the inflight/lookupDuration metrics inside it means only the one goroutine
+	// actually querying the resolver ever holds a slot, no matter how many followers pile up.
+	v, err, _ := c.group.Do(key.String(), func() (interface{}, error) {
+		c.inflightCh <- struct{}{}
+		c.metrics.inflight.Inc()
+		start := time.Now()
+		defer func() {
+			c.metrics.lookupDuration.Observe(time.Since(start).Seconds())
+			c.metrics.inflight.Dec()
+			<-c.inflightCh
+		}()
+		return fn()
+	})
+
+	var fields map[string][]string
+	if v != nil {
+		fields, _ = v.(map[string][]string)
+	}
+
+	ttl := c.successTTL
+	if err != nil {
+		ttl = c.failureTTL
+	}
+	c.cache.Add(key, &rdnsCacheEntry{
+		fields:    fields,
+		err:       err,
+		expiresAt: time.Now().Add(ttl),
+	})
+
+	return fields, err
+}
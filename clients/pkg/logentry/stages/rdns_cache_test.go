@@ -0,0 +1,123 @@
+package stages
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var errUnresolvable = errors.New("unresolvable")
+
+func Test_rdnsCache_coalescesConcurrentLookups(t *testing.T) {
+	cache, err := newRDNSCache(128, time.Minute, time.Minute, 0, newRDNSCacheMetrics(nil))
+	require.NoError(t, err)
+
+	var calls int64
+	lookupFn := func() (map[string][]string, error) {
+		atomic.AddInt64(&calls, 1)
+		time.Sleep(10 * time.Millisecond)
+		return map[string][]string{"hostnames": {"example.com"}}, nil
+	}
+
+	key := rdnsCacheKey{qtype: recordTypes["ptr"], name: "1.2.3.4"}
+
+	const n = 20
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			fields, err := cache.lookup(key, lookupFn)
+			require.NoError(t, err)
+			require.Equal(t, []string{"example.com"}, fields["hostnames"])
+		}()
+	}
+	wg.Wait()
+
+	require.Equal(t, int64(1), atomic.LoadInt64(&calls))
+}
+
+func Test_rdnsCache_servesFreshEntryWithoutCallingFn(t *testing.T) {
+	cache, err := newRDNSCache(128, time.Minute, time.Minute, 0, newRDNSCacheMetrics(nil))
+	require.NoError(t, err)
+
+	key := rdnsCacheKey{qtype: recordTypes["ptr"], name: "1.2.3.4"}
+	calls := 0
+	lookupFn := func() (map[string][]string, error) {
+		calls++
+		return map[string][]string{"hostnames": {"example.com"}}, nil
+	}
+
+	_, err = cache.lookup(key, lookupFn)
+	require.NoError(t, err)
+	_, err = cache.lookup(key, lookupFn)
+	require.NoError(t, err)
+
+	require.Equal(t, 1, calls)
+}
+
+func Test_rdnsCache_singleflightFollowersDontConsumeInflightSlots(t *testing.T) {
+	cache, err := newRDNSCache(128, time.Minute, time.Minute, 2, newRDNSCacheMetrics(nil))
+	require.NoError(t, err)
+
+	sharedKey := rdnsCacheKey{qtype: recordTypes["ptr"], name: "1.2.3.4"}
+	slowFn := func() (map[string][]string, error) {
+		time.Sleep(50 * time.Millisecond)
+		return map[string][]string{"hostnames": {"example.com"}}, nil
+	}
+
+	// A burst of lookups for the same key should coalesce into a single resolver call and
+	// a single inflight slot, no matter how many goroutines pile up behind it.
+	const n = 5
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			_, _ = cache.lookup(sharedKey, slowFn)
+		}()
+	}
+
+	// Give the burst a moment to start piling up behind the single in-flight leader, then
+	// confirm a lookup for a different key isn't blocked behind the followers' non-existent
+	// inflight slots.
+	time.Sleep(10 * time.Millisecond)
+
+	otherKey := rdnsCacheKey{qtype: recordTypes["ptr"], name: "5.6.7.8"}
+	fastFn := func() (map[string][]string, error) {
+		return map[string][]string{"hostnames": {"other.example.com"}}, nil
+	}
+
+	start := time.Now()
+	_, err = cache.lookup(otherKey, fastFn)
+	require.NoError(t, err)
+	require.Less(t, time.Since(start), 25*time.Millisecond, "unrelated lookup should not queue behind singleflight followers")
+
+	wg.Wait()
+}
+
+func Test_rdnsCache_negativeResultsExpireAfterFailureTTL(t *testing.T) {
+	cache, err := newRDNSCache(128, time.Minute, time.Millisecond, 0, newRDNSCacheMetrics(nil))
+	require.NoError(t, err)
+
+	key := rdnsCacheKey{qtype: recordTypes["ptr"], name: "1.2.3.4"}
+	calls := 0
+	lookupFn := func() (map[string][]string, error) {
+		calls++
+		return nil, errUnresolvable
+	}
+
+	_, err = cache.lookup(key, lookupFn)
+	require.Error(t, err)
+
+	time.Sleep(5 * time.Millisecond)
+
+	_, err = cache.lookup(key, lookupFn)
+	require.Error(t, err)
+
+	require.Equal(t, 2, calls)
+}
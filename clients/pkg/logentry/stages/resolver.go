@@ -0,0 +1,206 @@
+package stages
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	ErrEmptyResolverServers    = errors.New("resolver servers cannot be empty")
+	ErrInvalidResolverProtocol = errors.New("resolver protocol must be one of udp, tcp, tls")
+	ErrInvalidRDNSType         = errors.New("type must be one of ptr, a, aaaa, mx, txt, cname, srv")
+
+	// ErrDNSNameError indicates an authoritative NXDOMAIN response: the name does not
+	// exist, as opposed to a transient failure on the resolver's side.
+	ErrDNSNameError = errors.New("dns: name error (NXDOMAIN)")
+	// ErrDNSServerFailure indicates the resolver itself reported a failure (e.g. SERVFAIL)
+	// rather than an authoritative negative answer.
+	ErrDNSServerFailure = errors.New("dns: server failure")
+)
+
+const (
+	defaultResolverTimeout  = 2 * time.Second
+	defaultResolverRetries  = 1
+	defaultResolverProtocol = "udp"
+	defaultRDNSType         = "ptr"
+)
+
+// recordTypes maps a stage's `type` config value to the DNS question type it issues.
+var recordTypes = map[string]uint16{
+	"ptr":   dns.TypePTR,
+	"a":     dns.TypeA,
+	"aaaa":  dns.TypeAAAA,
+	"mx":    dns.TypeMX,
+	"txt":   dns.TypeTXT,
+	"cname": dns.TypeCNAME,
+	"srv":   dns.TypeSRV,
+}
+
+// ResolverConfig configures an explicit DNS resolver for the reverse_dns and dns stages.
+// When a stage's resolver block is omitted, the stage falls back to the operating
+// system resolver and only PTR (or the relevant system lookup) queries are available.
+type ResolverConfig struct {
+	Servers          []string      `mapstructure:"servers"`
+	Protocol         string        `mapstructure:"protocol"`
+	Timeout          time.Duration `mapstructure:"timeout"`
+	Retries          int           `mapstructure:"retries"`
+	RecursionDesired *bool         `mapstructure:"recursion_desired"`
+}
+
+func validateResolverConfig(c *ResolverConfig) error {
+	if c == nil {
+		return nil
+	}
+	if len(c.Servers) == 0 {
+		return ErrEmptyResolverServers
+	}
+	for _, s := range c.Servers {
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			return fmt.Errorf("resolver server %q must be host:port: %w", s, err)
+		}
+	}
+	switch c.Protocol {
+	case "", "udp", "tcp", "tls":
+	default:
+		return ErrInvalidResolverProtocol
+	}
+	return nil
+}
+
+// resolver issues DNS queries against an explicitly configured set of servers using miekg/dns.
+type resolver struct {
+	client           *dns.Client
+	servers          []string
+	retries          int
+	recursionDesired bool
+}
+
+// newResolver builds a resolver from a ResolverConfig. It returns a nil resolver (and
+// nil error) when cfg is nil, signalling that callers should fall back to the system resolver.
+func newResolver(cfg *ResolverConfig) (*resolver, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	if err := validateResolverConfig(cfg); err != nil {
+		return nil, err
+	}
+
+	proto := cfg.Protocol
+	switch proto {
+	case "":
+		proto = defaultResolverProtocol
+	case "tls":
+		proto = "tcp-tls"
+	}
+
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultResolverTimeout
+	}
+
+	retries := cfg.Retries
+	if retries <= 0 {
+		retries = defaultResolverRetries
+	}
+
+	recursionDesired := true
+	if cfg.RecursionDesired != nil {
+		recursionDesired = *cfg.RecursionDesired
+	}
+
+	return &resolver{
+		client: &dns.Client{
+			Net:     proto,
+			Timeout: timeout,
+		},
+		servers:          cfg.Servers,
+		retries:          retries,
+		recursionDesired: recursionDesired,
+	}, nil
+}
+
+// lookup sends a query for name/qtype to each configured server in turn, retrying up to
+// r.retries times per server, and returns the first successful, non-error response.
+// An authoritative NXDOMAIN is returned immediately, wrapping ErrDNSNameError, since
+// retrying elsewhere won't change the answer; any other non-success Rcode wraps
+// ErrDNSServerFailure and is retried like a transport error.
+func (r *resolver) lookup(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+	msg.RecursionDesired = r.recursionDesired
+
+	var lastErr error
+	for _, server := range r.servers {
+		for attempt := 0; attempt <= r.retries; attempt++ {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			resp, _, err := r.client.ExchangeContext(ctx, msg, server)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			switch resp.Rcode {
+			case dns.RcodeSuccess:
+				return resp, nil
+			case dns.RcodeNameError:
+				return nil, fmt.Errorf("%w: %s %s", ErrDNSNameError, dns.TypeToString[qtype], name)
+			default:
+				lastErr = fmt.Errorf("%w: %s %s against %s: %s", ErrDNSServerFailure, dns.TypeToString[qtype], name, server, dns.RcodeToString[resp.Rcode])
+				continue
+			}
+		}
+	}
+	return nil, lastErr
+}
+
+// budget returns a reasonable upper bound on how long a single lookup() call may take,
+// used to derive a per-entry deadline so a slow or unreachable server can't stall a
+// pipeline entry indefinitely.
+func (r *resolver) budget() time.Duration {
+	return r.client.Timeout * time.Duration(r.retries+1) * time.Duration(len(r.servers))
+}
+
+// extractAnswers pulls the fields relevant to qtype out of a DNS answer section, returning
+// the key/value pairs that should be merged into the pipeline's extracted map and labels.
+func extractAnswers(msg *dns.Msg, qtype uint16) map[string][]string {
+	out := map[string][]string{}
+	for _, rr := range msg.Answer {
+		switch qtype {
+		case dns.TypePTR:
+			if a, ok := rr.(*dns.PTR); ok {
+				out["hostnames"] = append(out["hostnames"], normaliseHost(a.Ptr))
+			}
+		case dns.TypeA:
+			if a, ok := rr.(*dns.A); ok {
+				out["addresses"] = append(out["addresses"], a.A.String())
+			}
+		case dns.TypeAAAA:
+			if a, ok := rr.(*dns.AAAA); ok {
+				out["addresses"] = append(out["addresses"], a.AAAA.String())
+			}
+		case dns.TypeMX:
+			if a, ok := rr.(*dns.MX); ok {
+				out["mx_hosts"] = append(out["mx_hosts"], fmt.Sprintf("%d:%s", a.Preference, normaliseHost(a.Mx)))
+			}
+		case dns.TypeTXT:
+			if a, ok := rr.(*dns.TXT); ok {
+				out["txt_records"] = append(out["txt_records"], a.Txt...)
+			}
+		case dns.TypeCNAME:
+			if a, ok := rr.(*dns.CNAME); ok {
+				out["cnames"] = append(out["cnames"], normaliseHost(a.Target))
+			}
+		case dns.TypeSRV:
+			if a, ok := rr.(*dns.SRV); ok {
+				out["srv_targets"] = append(out["srv_targets"], fmt.Sprintf("%d:%d:%d:%s", a.Priority, a.Weight, a.Port, normaliseHost(a.Target)))
+			}
+		}
+	}
+	return out
+}
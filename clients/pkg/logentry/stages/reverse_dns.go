@@ -1,14 +1,17 @@
 package stages
 
 import (
+	"context"
 	"errors"
 	"net"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
-	"github.com/mitchellh/mapstructure"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
 )
 
@@ -19,19 +22,30 @@ var (
 
 // RDNSConfig represents Reverse DNS stage config
 type RDNSConfig struct {
-	Source *string `mapstructure:"source"`
+	Source      *string         `mapstructure:"source"`
+	Type        string          `mapstructure:"type"`
+	Resolver    *ResolverConfig `mapstructure:"resolver"`
+	CacheSize   int             `mapstructure:"cache_size"`
+	SuccessTTL  time.Duration   `mapstructure:"success_ttl"`
+	FailureTTL  time.Duration   `mapstructure:"failure_ttl"`
+	MaxInflight int             `mapstructure:"max_inflight"`
 }
 
 func validateRDNSConfig(c RDNSConfig) error {
 	if c.Source != nil && *c.Source == "" {
 		return ErrEmptySourceRDNSStageConfig
 	}
-	return nil
+	if c.Type != "" {
+		if _, ok := recordTypes[c.Type]; !ok {
+			return ErrInvalidRDNSType
+		}
+	}
+	return validateResolverConfig(c.Resolver)
 }
 
-func newRDNSStage(logger log.Logger, configs interface{}) (Stage, error) {
+func newRDNSStage(logger log.Logger, configs interface{}, registerer prometheus.Registerer) (Stage, error) {
 	cfgs := &RDNSConfig{}
-	err := mapstructure.Decode(configs, cfgs)
+	err := decodeConfig(configs, cfgs)
 	if err != nil {
 		return nil, err
 	}
@@ -41,15 +55,36 @@ func newRDNSStage(logger log.Logger, configs interface{}) (Stage, error) {
 		return nil, err
 	}
 
+	qtype := defaultRDNSType
+	if cfgs.Type != "" {
+		qtype = cfgs.Type
+	}
+
+	res, err := newResolver(cfgs.Resolver)
+	if err != nil {
+		return nil, err
+	}
+
+	cache, err := newRDNSCache(cfgs.CacheSize, cfgs.SuccessTTL, cfgs.FailureTTL, cfgs.MaxInflight, newRDNSCacheMetrics(registerer))
+	if err != nil {
+		return nil, err
+	}
+
 	return &reverseDNSStage{
-		logger: logger,
-		cfgs:   cfgs,
+		logger:   logger,
+		cfgs:     cfgs,
+		qtype:    recordTypes[qtype],
+		resolver: res,
+		cache:    cache,
 	}, nil
 }
 
 type reverseDNSStage struct {
-	logger log.Logger
-	cfgs   *RDNSConfig
+	logger   log.Logger
+	cfgs     *RDNSConfig
+	qtype    uint16
+	resolver *resolver
+	cache    *rdnsCache
 }
 
 // Run implements Stage
@@ -98,23 +133,67 @@ func (g *reverseDNSStage) process(labels model.LabelSet, extracted map[string]in
 			return
 		}
 	}
-	// TODO: allow configuration to use a specific resolver
-	names, err := net.LookupAddr(ip.String())
+	ctx, cancel := context.WithTimeout(context.Background(), g.lookupTimeout())
+	defer cancel()
+
+	fields, err := g.lookup(ctx, ip)
 	if err != nil {
-		level.Debug(g.logger).Log("msg", "dns reverse lookup failed", "source", ip.String())
+		switch {
+		case errors.Is(err, ErrDNSNameError):
+			level.Debug(g.logger).Log("msg", "dns reverse lookup returned NXDOMAIN", "source", ip.String())
+		case errors.Is(err, ErrDNSServerFailure):
+			level.Warn(g.logger).Log("msg", "dns reverse lookup failed: resolver error", "source", ip.String(), "err", err)
+		default:
+			level.Debug(g.logger).Log("msg", "dns reverse lookup failed", "source", ip.String(), "err", err)
+		}
 		return
 	}
-	if len(names) > 0 {
-		hostnames := ""
-		for i, name := range names {
-			hostnames += normaliseHost(name)
-			if i < len(names)-1 {
-				hostnames += ";"
+
+	for key, values := range fields {
+		if len(values) == 0 {
+			continue
+		}
+		joined := strings.Join(values, ";")
+		labels[model.LabelName(key)] = model.LabelValue(joined)
+		extracted[key] = joined // WTF
+	}
+}
+
+// lookup resolves ip using the configured resolver, falling back to net.DefaultResolver
+// when no resolver block is configured in order to preserve the stage's original behaviour,
+// while still honoring ctx's cancellation/deadline. Results, including negative ones, are
+// served from g.cache where possible so that a burst of entries for the same ip only
+// issues a single underlying query.
+func (g *reverseDNSStage) lookup(ctx context.Context, ip net.IP) (map[string][]string, error) {
+	key := rdnsCacheKey{qtype: g.qtype, name: ip.String()}
+	return g.cache.lookup(key, func() (map[string][]string, error) {
+		if g.resolver == nil {
+			names, err := net.DefaultResolver.LookupAddr(ctx, ip.String())
+			if err != nil {
+				return nil, err
 			}
+			hostnames := make([]string, 0, len(names))
+			for _, name := range names {
+				hostnames = append(hostnames, normaliseHost(name))
+			}
+			return map[string][]string{"hostnames": hostnames}, nil
+		}
+
+		msg, err := g.resolver.lookup(ctx, reverseLookupName(ip), g.qtype)
+		if err != nil {
+			return nil, err
 		}
-		labels[model.LabelName("hostnames")] = model.LabelValue(hostnames)
-		extracted["hostnames"] = hostnames // WTF
+		return extractAnswers(msg, g.qtype), nil
+	})
+}
+
+// lookupTimeout returns the per-entry deadline to apply to a lookup so that an
+// unreachable or slow resolver cannot stall the pipeline beyond the configured budget.
+func (g *reverseDNSStage) lookupTimeout() time.Duration {
+	if g.resolver == nil {
+		return defaultResolverTimeout
 	}
+	return g.resolver.budget()
 }
 
 func (d *reverseDNSStage) close() {
@@ -124,3 +203,12 @@ func (d *reverseDNSStage) close() {
 func normaliseHost(ptr string) string {
 	return strings.TrimSuffix(ptr, ".")
 }
+
+// reverseLookupName builds the in-addr.arpa/ip6.arpa name used for PTR queries.
+func reverseLookupName(ip net.IP) string {
+	name, err := dns.ReverseAddr(ip.String())
+	if err != nil {
+		return ip.String()
+	}
+	return name
+}
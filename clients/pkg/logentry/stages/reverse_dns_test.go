@@ -1,15 +1,46 @@
 package stages
 
 import (
+	"net"
 	"testing"
+	"time"
 
 	util_log "github.com/grafana/loki/pkg/util/log"
+	"github.com/miekg/dns"
 	"github.com/prometheus/common/model"
 	"github.com/stretchr/testify/require"
 )
 
+// startTestDNSServer starts an in-process DNS server backed by handler and returns the
+// address it is listening on. The server is shut down when the test finishes.
+func startTestDNSServer(t *testing.T, handler dns.HandlerFunc) string {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := &dns.Server{PacketConn: pc, Handler: handler}
+	go func() {
+		_ = server.ActivateAndServe()
+	}()
+	t.Cleanup(func() {
+		_ = server.Shutdown()
+	})
+
+	return pc.LocalAddr().String()
+}
+
 var logger = util_log.Logger
 
+// newTestRDNSCache returns a fresh, unregistered cache for use in tests that construct
+// a reverseDNSStage directly rather than going through newRDNSStage.
+func newTestRDNSCache(t *testing.T) *rdnsCache {
+	t.Helper()
+	c, err := newRDNSCache(0, 0, 0, 0, newRDNSCacheMetrics(nil))
+	require.NoError(t, err)
+	return c
+}
+
 func Test_Reverse_DNS_process(t *testing.T) {
 	type fields struct {
 		cfgs *RDNSConfig
@@ -75,6 +106,7 @@ func Test_Reverse_DNS_process(t *testing.T) {
 			g := &reverseDNSStage{
 				logger: logger,
 				cfgs:   tt.fields.cfgs,
+				cache:  newTestRDNSCache(t),
 			}
 			g.process(tt.args.labels, tt.args.extracted)
 			require.Equal(t, tt.expected, tt.args.labels)
@@ -82,6 +114,125 @@ func Test_Reverse_DNS_process(t *testing.T) {
 	}
 }
 
+func Test_Reverse_DNS_process_withResolver(t *testing.T) {
+	addr := startTestDNSServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		q := r.Question[0]
+		switch q.Qtype {
+		case dns.TypePTR:
+			rr, err := dns.NewRR(q.Name + " 60 IN PTR example.com.")
+			require.NoError(t, err)
+			m.Answer = append(m.Answer, rr)
+		case dns.TypeAAAA:
+			rr, err := dns.NewRR(q.Name + " 60 IN AAAA ::1")
+			require.NoError(t, err)
+			m.Answer = append(m.Answer, rr)
+		default:
+			m.Rcode = dns.RcodeNameError
+		}
+		_ = w.WriteMsg(m)
+	})
+
+	field := "ip"
+
+	t.Run("ptr over configured resolver", func(t *testing.T) {
+		cfgs := &RDNSConfig{
+			Source:   &field,
+			Resolver: &ResolverConfig{Servers: []string{addr}},
+		}
+		res, err := newResolver(cfgs.Resolver)
+		require.NoError(t, err)
+		g := &reverseDNSStage{logger: logger, cfgs: cfgs, qtype: recordTypes["ptr"], resolver: res, cache: newTestRDNSCache(t)}
+
+		labels := model.LabelSet{}
+		g.process(labels, map[string]interface{}{"ip": "1.2.3.4"})
+		require.Equal(t, model.LabelSet{model.LabelName("hostnames"): model.LabelValue("example.com")}, labels)
+	})
+
+	t.Run("aaaa via ipv6 PTR source", func(t *testing.T) {
+		cfgs := &RDNSConfig{
+			Source:   &field,
+			Type:     "aaaa",
+			Resolver: &ResolverConfig{Servers: []string{addr}},
+		}
+		res, err := newResolver(cfgs.Resolver)
+		require.NoError(t, err)
+		g := &reverseDNSStage{logger: logger, cfgs: cfgs, qtype: recordTypes["aaaa"], resolver: res, cache: newTestRDNSCache(t)}
+
+		labels := model.LabelSet{}
+		g.process(labels, map[string]interface{}{"ip": "::1"})
+		require.Equal(t, model.LabelSet{model.LabelName("addresses"): model.LabelValue("::1")}, labels)
+	})
+
+	t.Run("nxdomain via configured resolver", func(t *testing.T) {
+		cfgs := &RDNSConfig{
+			Source:   &field,
+			Type:     "mx",
+			Resolver: &ResolverConfig{Servers: []string{addr}},
+		}
+		res, err := newResolver(cfgs.Resolver)
+		require.NoError(t, err)
+		g := &reverseDNSStage{logger: logger, cfgs: cfgs, qtype: recordTypes["mx"], resolver: res, cache: newTestRDNSCache(t)}
+
+		labels := model.LabelSet{}
+		g.process(labels, map[string]interface{}{"ip": "1.2.3.4"})
+		require.Equal(t, model.LabelSet{}, labels)
+	})
+}
+
+func Test_newResolver(t *testing.T) {
+	t.Run("nil config", func(t *testing.T) {
+		r, err := newResolver(nil)
+		require.NoError(t, err)
+		require.Nil(t, r)
+	})
+
+	t.Run("default protocol and timeout", func(t *testing.T) {
+		r, err := newResolver(&ResolverConfig{Servers: []string{"127.0.0.1:53"}})
+		require.NoError(t, err)
+		require.Equal(t, "udp", r.client.Net)
+		require.Equal(t, defaultResolverTimeout, r.client.Timeout)
+	})
+
+	t.Run("tls protocol maps to tcp-tls", func(t *testing.T) {
+		r, err := newResolver(&ResolverConfig{Servers: []string{"127.0.0.1:853"}, Protocol: "tls"})
+		require.NoError(t, err)
+		require.Equal(t, "tcp-tls", r.client.Net)
+	})
+
+	t.Run("rejects empty servers", func(t *testing.T) {
+		_, err := newResolver(&ResolverConfig{})
+		require.ErrorIs(t, err, ErrEmptyResolverServers)
+	})
+
+	t.Run("rejects malformed server address", func(t *testing.T) {
+		_, err := newResolver(&ResolverConfig{Servers: []string{"not-a-host-port"}})
+		require.Error(t, err)
+	})
+}
+
+func Test_newRDNSStage_decodesDurationsFromYAMLStrings(t *testing.T) {
+	// pipeline_stages config arrives as a map[string]interface{} decoded from YAML, so
+	// durations come in as strings like "2s", not time.Duration values.
+	raw := map[string]interface{}{
+		"resolver": map[string]interface{}{
+			"servers": []interface{}{"127.0.0.1:53"},
+			"timeout": "2s",
+		},
+		"success_ttl": "10m",
+		"failure_ttl": "15s",
+	}
+
+	stage, err := newRDNSStage(logger, raw, nil)
+	require.NoError(t, err)
+
+	g := stage.(*reverseDNSStage)
+	require.Equal(t, 2*time.Second, g.resolver.client.Timeout)
+	require.Equal(t, 10*time.Minute, g.cache.successTTL)
+	require.Equal(t, 15*time.Second, g.cache.failureTTL)
+}
+
 var validDest = "destination"
 
 func Test_validateRDNSConfig(t *testing.T) {
@@ -109,6 +260,27 @@ func Test_validateRDNSConfig(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"valid type",
+			args{
+				RDNSConfig{Type: "mx"},
+			},
+			false,
+		},
+		{
+			"invalid type",
+			args{
+				RDNSConfig{Type: "bogus"},
+			},
+			true,
+		},
+		{
+			"invalid resolver",
+			args{
+				RDNSConfig{Resolver: &ResolverConfig{}},
+			},
+			true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -0,0 +1,91 @@
+package stages
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/go-kit/log"
+	"github.com/mitchellh/mapstructure"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+// Debug enables verbose, per-entry debug logging across all stages in this package.
+var Debug = false
+
+// Stage takes an incoming entry channel, mutates each entry's labels and extracted
+// fields, and forwards it on the returned channel.
+type Stage interface {
+	Name() string
+	Run(in chan Entry) chan Entry
+}
+
+// Entry is a single log line flowing through a pipeline, along with the label set and
+// extracted fields accumulated by the stages that have already run on it.
+type Entry struct {
+	Extracted map[string]interface{}
+	Labels    model.LabelSet
+}
+
+// StageType identifies a stage's config key within a pipeline_stages entry.
+const (
+	StageTypeReverseDNS = "reverse_dns"
+	StageTypeDNS        = "dns"
+)
+
+// PipelineStage is a single pipeline_stages list entry: exactly one key naming the stage
+// type, mapped to that stage's own config.
+type PipelineStage map[string]interface{}
+
+// ErrUnknownStageType is returned by New when a pipeline_stages entry names a stage type
+// this package doesn't know how to construct.
+var ErrUnknownStageType = errors.New("unknown stage type")
+
+// New builds the Stage described by a single pipeline_stages entry.
+func New(logger log.Logger, config PipelineStage, registerer prometheus.Registerer) (Stage, error) {
+	for stageType, stageConfig := range config {
+		switch stageType {
+		case StageTypeReverseDNS:
+			return newRDNSStage(logger, stageConfig, registerer)
+		case StageTypeDNS:
+			return newDNSStage(logger, stageConfig, registerer)
+		default:
+			return nil, fmt.Errorf("%w: %s", ErrUnknownStageType, stageType)
+		}
+	}
+	return nil, ErrUnknownStageType
+}
+
+// decodeConfig decodes a pipeline_stages entry's raw config into out, honoring
+// time.Duration fields written as YAML strings (e.g. "2s") rather than requiring
+// operators to spell out a nanosecond count.
+func decodeConfig(unk interface{}, out interface{}) error {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.StringToTimeDurationHookFunc(),
+		Result:     out,
+	})
+	if err != nil {
+		return err
+	}
+	return decoder.Decode(unk)
+}
+
+// getString coerces a value extracted from a log line (typically decoded from JSON or
+// logfmt) into the string form every stage that reads `extracted` works with.
+func getString(unk interface{}) (string, error) {
+	switch v := unk.(type) {
+	case string:
+		return v, nil
+	case fmt.Stringer:
+		return v.String(), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	default:
+		return "", fmt.Errorf("can't convert %v to string", unk)
+	}
+}